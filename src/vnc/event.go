@@ -0,0 +1,107 @@
+// Copyright (2019) Sandia Corporation.
+// Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+// the U.S. Government retains certain rights in this software.
+
+package vnc
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// waitForItPrefix is how a WaitForItEvent line or Inject command is
+// recognized, the same way "Keyframe," marks a keyframeSpec line.
+const waitForItPrefix = "WaitForIt:"
+
+// defaultWaitForItTimeout is how long waitForIt waits for a match when a
+// WaitForIt line doesn't specify its own timeout=.
+const defaultWaitForItTimeout = 30 * time.Second
+
+// WaitForItEvent is a pseudo-event parsed from a playback file line (or an
+// Inject command) of the form
+// "WaitForIt:<file>[,timeout=3s][,rect=x0;y0;x1;y1][,threshold=N]" --
+// rather than being written to the VNC connection, it blocks playback
+// until the framebuffer perceptually matches the reference PNG named by
+// File, or Timeout elapses.
+type WaitForItEvent struct {
+	File      string
+	Timeout   int64           // nanoseconds to wait before giving up
+	Rect      image.Rectangle // region to crop to before hashing; zero value means the whole screen
+	Threshold int             // max Hamming distance to call a match; 0 means defaultHashThreshold
+}
+
+// LoadFileEvent is a pseudo-event parsed from a "LoadFile:<file>" playback
+// file line -- rather than being written to the VNC connection, it
+// recurses playFile into another file, same as a nested script include.
+type LoadFileEvent struct {
+	File string
+}
+
+// parseWaitForItEvent parses the body of a WaitForIt line or Inject
+// command -- everything after the "WaitForIt:" prefix -- of the form
+// "<file>[,timeout=3s][,rect=x0;y0;x1;y1][,threshold=N]". File is
+// positional and required; Timeout, Rect and Threshold are optional
+// key=value suffixes, same convention parseKeyframeSpec uses for
+// "Keyframe,sha256=...,file=...".
+func parseWaitForItEvent(s string) (*WaitForItEvent, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) == 0 || parts[0] == "" {
+		return nil, fmt.Errorf("WaitForIt line missing file: %v", s)
+	}
+
+	e := &WaitForItEvent{File: parts[0], Timeout: int64(defaultWaitForItTimeout)}
+
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "timeout":
+			d, err := time.ParseDuration(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid timeout in WaitForIt line %v: %v", s, err)
+			}
+			e.Timeout = int64(d)
+		case "threshold":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid threshold in WaitForIt line %v: %v", s, err)
+			}
+			e.Threshold = n
+		case "rect":
+			r, err := parseRect(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid rect in WaitForIt line %v: %v", s, err)
+			}
+			e.Rect = r
+		}
+	}
+
+	return e, nil
+}
+
+// parseRect parses a "x0;y0;x1;y1" rectangle, as used by WaitForIt's
+// optional rect= suffix to restrict image matching to a screen region
+// such as a login banner or dialog.
+func parseRect(s string) (image.Rectangle, error) {
+	fields := strings.Split(s, ";")
+	if len(fields) != 4 {
+		return image.Rectangle{}, fmt.Errorf("rect must have 4 fields x0;y0;x1;y1, got %v", s)
+	}
+
+	var vals [4]int
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return image.Rectangle{}, err
+		}
+		vals[i] = n
+	}
+
+	return image.Rect(vals[0], vals[1], vals[2], vals[3]), nil
+}
@@ -0,0 +1,117 @@
+// Copyright (2019) Sandia Corporation.
+// Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+// the U.S. Government retains certain rights in this software.
+
+package vnc
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	log "minilog"
+	"os"
+	"strings"
+	"time"
+)
+
+// currentPlaybackFileVersion is the highest playback file version this
+// build knows how to play back. Files recorded with a newer version are
+// rejected outright rather than risking a silent misplay.
+const currentPlaybackFileVersion = 1
+
+// playbackHeader is the optional JSON metadata record that may appear as
+// the first line of a playback file, borrowed from the self-describing
+// container format used by mongoreplay. A file that doesn't start with
+// one is treated as an implicit version 0, for backward compatibility
+// with recordings made before this header existed.
+type playbackHeader struct {
+	PlaybackFileVersion int    `json:"PlaybackFileVersion"`
+	Recorded            string `json:"Recorded"`
+	Width               int    `json:"Width"`
+	Height              int    `json:"Height"`
+	Compression         string `json:"Compression"`
+	SHA256              string `json:"SHA256"`
+}
+
+// openPlaybackFile sniffs f for a leading JSON header, transparently
+// wraps it in a gzip reader when the header calls for one, and returns a
+// scanner positioned at the first event line. header is nil for the
+// headerless v0 format.
+func openPlaybackFile(f *os.File) (*bufio.Scanner, *playbackHeader, error) {
+	r := bufio.NewReader(f)
+
+	peek, err := r.Peek(1)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	if len(peek) == 0 || peek[0] != '{' {
+		// no header -- implicit v0, plain duration:event lines
+		return bufio.NewScanner(r), nil, nil
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	header := &playbackHeader{}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), header); err != nil {
+		return nil, nil, fmt.Errorf("invalid playback header: %v", err)
+	}
+
+	if header.PlaybackFileVersion > currentPlaybackFileVersion {
+		return nil, nil, fmt.Errorf("playback file version %v is newer than this build supports (max %v)", header.PlaybackFileVersion, currentPlaybackFileVersion)
+	}
+
+	var body io.Reader = r
+
+	switch header.Compression {
+	case "", "none":
+		// nothing to do
+	case "gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to open gzip playback stream: %v", err)
+		}
+		body = gz
+	default:
+		return nil, nil, fmt.Errorf("unknown playback compression: %v", header.Compression)
+	}
+
+	return bufio.NewScanner(body), header, nil
+}
+
+// getDuration returns the total scheduled duration of the event stream in
+// f, honoring a metadata header and optional gzip compression if present.
+// f's read position is restored before returning so a subsequent, fresh
+// scan (as playFile does) starts from the beginning of the file.
+func getDuration(f *os.File) time.Duration {
+	defer f.Seek(0, io.SeekStart)
+
+	scanner, _, err := openPlaybackFile(f)
+	if err != nil {
+		log.Error("unable to read playback file %v: %v", f.Name(), err)
+		return 0
+	}
+
+	var total time.Duration
+
+	for scanner.Scan() {
+		s := strings.SplitN(scanner.Text(), ":", 2)
+		if len(s) != 2 || strings.HasPrefix(s[0], "#") {
+			continue
+		}
+
+		d, err := time.ParseDuration(s[0] + "ns")
+		if err != nil {
+			continue
+		}
+
+		total += d
+	}
+
+	return total
+}
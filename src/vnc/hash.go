@@ -0,0 +1,108 @@
+// Copyright (2019) Sandia Corporation.
+// Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+// the U.S. Government retains certain rights in this software.
+
+package vnc
+
+import "image"
+
+// defaultHashThreshold is the maximum Hamming distance between two dHash
+// fingerprints for them to be considered a match, used when a
+// WaitForItEvent does not specify its own Threshold.
+const defaultHashThreshold = 5
+
+// dHash computes a 64-bit difference hash of img. The image is downscaled
+// to a 9x8 grayscale thumbnail (using a box average so we don't need an
+// external resizing library) and then, for each of the 8x8 adjacent pixel
+// pairs, a bit is set when the left pixel is brighter than its right
+// neighbor. Similar images produce hashes with a small Hamming distance.
+func dHash(img image.Image) uint64 {
+	gray := shrinkGray(img, 9, 8)
+
+	var hash uint64
+	var bit uint
+
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1 << bit
+			}
+			bit++
+		}
+	}
+
+	return hash
+}
+
+// hammingDistance returns the number of bits that differ between a and b.
+func hammingDistance(a, b uint64) int {
+	x := a ^ b
+
+	var n int
+	for x != 0 {
+		x &= x - 1
+		n++
+	}
+
+	return n
+}
+
+// crop returns the portion of img bounded by r, or img itself when r is
+// the zero Rectangle (meaning "the whole image").
+func crop(img image.Image, r image.Rectangle) image.Image {
+	if r == (image.Rectangle{}) {
+		return img
+	}
+
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(r)
+	}
+
+	return img
+}
+
+// shrinkGray downscales img to w by h using a box average over the source
+// pixels that fall into each destination cell, converting to grayscale
+// using the standard luma weights along the way.
+func shrinkGray(img image.Image, w, h int) [][]float64 {
+	bounds := img.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+
+	out := make([][]float64, h)
+	for y := range out {
+		out[y] = make([]float64, w)
+	}
+
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + y*sh/h
+		y1 := bounds.Min.Y + (y+1)*sh/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + x*sw/w
+			x1 := bounds.Min.X + (x+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var sum float64
+			var n int
+
+			for yy := y0; yy < y1; yy++ {
+				for xx := x0; xx < x1; xx++ {
+					r, g, b, _ := img.At(xx, yy).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+					n++
+				}
+			}
+
+			out[y][x] = sum / float64(n)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,166 @@
+// Copyright (2019) Sandia Corporation.
+// Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+// the U.S. Government retains certain rights in this software.
+
+package vnc
+
+import (
+	"errors"
+	"fmt"
+	"image/png"
+	log "minilog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// keyframePolicy controls what playFile does when a recorded keyframe
+// doesn't match the live framebuffer during replay.
+type keyframePolicy int
+
+const (
+	// KeyframeContinue logs the mismatch and keeps playing.
+	KeyframeContinue keyframePolicy = iota
+	// KeyframePause pauses playback on mismatch, same as a Pause signal,
+	// so an operator can look at what desynced things before resuming.
+	KeyframePause
+	// KeyframeAbort stops playback outright on mismatch.
+	KeyframeAbort
+)
+
+// keyframeSpec is a parsed "Keyframe,sha256=...,file=..." line, written
+// by recorder alongside the input events it captures.
+type keyframeSpec struct {
+	SHA256 string
+	File   string
+}
+
+// parseKeyframeSpec parses a "Keyframe,sha256=...,file=..." line, as
+// written by recorder.RecordKeyframe.
+func parseKeyframeSpec(s string) (*keyframeSpec, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) == 0 || parts[0] != "Keyframe" {
+		return nil, fmt.Errorf("not a keyframe line: %v", s)
+	}
+
+	spec := &keyframeSpec{}
+
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "sha256":
+			spec.SHA256 = kv[1]
+		case "file":
+			spec.File = kv[1]
+		}
+	}
+
+	if spec.File == "" {
+		return nil, fmt.Errorf("keyframe line missing file: %v", s)
+	}
+
+	return spec, nil
+}
+
+// SetKeyframePolicy changes what happens when a recorded keyframe fails
+// to match the live framebuffer during replay.
+func (p *playback) SetKeyframePolicy(policy keyframePolicy) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		return errors.New("playback has already stopped")
+	}
+
+	p.kfPolicy = policy
+
+	return nil
+}
+
+func (p *playback) getKeyframePolicy() keyframePolicy {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.kfPolicy
+}
+
+// verifyKeyframe requests a fresh framebuffer, waits for the next
+// screenshot, and compares it against the reference PNG named by spec
+// using the same dHash approach as waitForIt. On mismatch it logs the
+// delta and applies v's keyframe policy.
+func (v *playback) verifyKeyframe(parent *os.File, spec *keyframeSpec) error {
+	filename := spec.File
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(filepath.Dir(parent.Name()), filename)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("unable to open keyframe %v: %v", filename, err)
+	}
+
+	ref, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("unable to decode keyframe %v: %v", filename, err)
+	}
+
+	refHash := dHash(ref)
+
+	fb := &FramebufferUpdateRequest{
+		Width:  v.Conn.s.Width,
+		Height: v.Conn.s.Height,
+	}
+	if err := fb.Write(v.Conn); err != nil {
+		return err
+	}
+
+	sub := v.subscribeScreenshots()
+	defer v.unsubscribeScreenshots(sub)
+
+	select {
+	case <-v.ctx.Done():
+		return nil
+	case screenshot := <-sub:
+		dist := hammingDistance(dHash(screenshot), refHash)
+
+		if dist <= defaultHashThreshold {
+			log.Info("playback %v: keyframe %v matched, hamming distance %v", v.ID, spec.File, dist)
+			return nil
+		}
+
+		log.Warn("playback %v: keyframe %v mismatched, hamming distance %v", v.ID, spec.File, dist)
+
+		switch v.getKeyframePolicy() {
+		case KeyframeAbort:
+			return fmt.Errorf("keyframe %v mismatched (hamming distance %v)", spec.File, dist)
+		case KeyframePause:
+			// mark ourselves paused so Continue sends the Play we wait for
+			v.Lock()
+			v.state = Pause
+			v.Unlock()
+
+			select {
+			case <-v.ctx.Done():
+				return nil
+			case sig := <-v.signal:
+				if sig.kind != Play {
+					log.Error("unexpected signal: %v", sig)
+
+					v.Lock()
+					v.state = Play
+					v.Unlock()
+				}
+			}
+		}
+
+		return nil
+	case <-time.After(5 * time.Second):
+		return fmt.Errorf("timeout requesting keyframe %v", spec.File)
+	}
+}
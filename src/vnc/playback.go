@@ -6,6 +6,7 @@ package vnc
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"image"
@@ -26,19 +27,26 @@ type playback struct {
 
 	start time.Time // start for when the playback started
 
-	out         chan Event // events to write to vnc server
-	signal      chan signal
-	done        chan bool        // teardown playback
-	screenshots chan *image.RGBA // screenshots of the VM
-
-	sync.Mutex               // guards below
-	depth      int           // how nested we are in LoadFiles
-	duration   time.Duration // total playback duration
-	e          string        // current event
-	state      Control       // playback state, only Play or Pause
-	closed     bool          // set after playback closed
-	file       *os.File      // file that we are reading
-	err        error         // error
+	ctx    context.Context    // bounds the lifetime of this playback
+	cancel context.CancelFunc // tears down ctx, e.g. from Stop
+
+	out    chan Event // events to write to vnc server
+	signal chan signal
+	done   chan bool // closed once the playback goroutine unwinds
+
+	sync.Mutex                                // guards below
+	depth          int                        // how nested we are in LoadFiles
+	duration       time.Duration              // total playback duration
+	e              string                     // current event
+	state          Control                    // playback state, only Play or Pause
+	closed         bool                       // set after playback closed
+	file           *os.File                   // file that we are reading
+	header         *playbackHeader            // metadata header of file, nil if headerless v0
+	speed          float64                    // playback speed multiplier
+	stream         *Stream                    // live HLS stream of the framebuffer, nil until requested
+	kfPolicy       keyframePolicy             // what to do when a recorded keyframe doesn't match
+	screenshotSubs map[chan *image.RGBA]bool  // registered consumers of framebuffer screenshots, see subscribeScreenshots
+	err            error                      // error
 }
 
 type signal struct {
@@ -46,21 +54,28 @@ type signal struct {
 	data interface{}
 }
 
-// newPlayback creates a new playback with given id.
-func newPlayback(id, rhost string) (*playback, error) {
+// newPlayback creates a new playback with given id. parent bounds the
+// overall lifetime of the playback -- cancelling it (or calling Stop)
+// tears down every goroutine playback spawns.
+func newPlayback(parent context.Context, id, rhost string) (*playback, error) {
 	conn, err := Dial(rhost)
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(parent)
+
 	return &playback{
-		ID:          id,
-		Conn:        conn,
-		out:         make(chan Event),
-		signal:      make(chan signal),
-		done:        make(chan bool),
-		screenshots: make(chan *image.RGBA),
-		state:       Play,
+		ID:             id,
+		Conn:           conn,
+		ctx:            ctx,
+		cancel:         cancel,
+		out:            make(chan Event),
+		signal:         make(chan signal),
+		done:           make(chan bool),
+		screenshotSubs: make(map[chan *image.RGBA]bool),
+		state:          Play,
+		speed:          1.0,
 	}, nil
 }
 
@@ -92,6 +107,10 @@ func (p *playback) Info() []string {
 
 	res = append(res, p.file.Name())
 
+	if p.header != nil {
+		res = append(res, fmt.Sprintf("v%v recorded %v", p.header.PlaybackFileVersion, p.header.Recorded))
+	}
+
 	return res
 }
 
@@ -113,6 +132,8 @@ func (p *playback) Start(filename string) error {
 
 	go p.writeEvents()
 	go func() {
+		defer close(p.done)
+
 		if err := p.playFile(nil, filename); err != nil {
 			log.Error("playback failed: %v", err)
 		}
@@ -127,6 +148,12 @@ func (p *playback) Start(filename string) error {
 	go func() {
 		// consume responses from the server
 		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			default:
+			}
+
 			msg, err := p.Conn.ReadMessage()
 			if err != nil {
 				log.Error("server to playback error: %v", err)
@@ -142,10 +169,10 @@ func (p *playback) Start(filename string) error {
 					}
 
 					select {
-					case p.screenshots <- rect.RGBA:
-						// success
+					case <-p.ctx.Done():
+						return
 					default:
-						// drop
+						p.broadcastScreenshot(rect.RGBA)
 					}
 				}
 			case *SetColorMapEntries:
@@ -165,7 +192,11 @@ func (p *playback) Step() error {
 		return errors.New("playback not stepable")
 	}
 
-	p.signal <- signal{kind: Step}
+	select {
+	case p.signal <- signal{kind: Step}:
+	case <-p.ctx.Done():
+		return errors.New("playback has already stopped")
+	}
 
 	return nil
 }
@@ -178,7 +209,11 @@ func (p *playback) Pause() error {
 		return errors.New("playback not pauseable")
 	}
 
-	p.signal <- signal{kind: Pause}
+	select {
+	case p.signal <- signal{kind: Pause}:
+	case <-p.ctx.Done():
+		return errors.New("playback has already stopped")
+	}
 	p.state = Pause
 
 	return nil
@@ -192,12 +227,60 @@ func (p *playback) Continue() error {
 		return errors.New("playback not playable")
 	}
 
-	p.signal <- signal{kind: Play}
+	select {
+	case p.signal <- signal{kind: Play}:
+	case <-p.ctx.Done():
+		return errors.New("playback has already stopped")
+	}
 	p.state = Play
 
 	return nil
 }
 
+// SetSpeed changes the played-back rate; f=2.0 plays twice as fast, f=0.5
+// half as fast. Takes effect on the wait currently in progress.
+func (p *playback) SetSpeed(f float64) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		return errors.New("playback has already stopped")
+	}
+	if f <= 0 {
+		return errors.New("playback speed must be positive")
+	}
+
+	select {
+	case p.signal <- signal{kind: Speed, data: f}:
+	case <-p.ctx.Done():
+		return errors.New("playback has already stopped")
+	}
+
+	return nil
+}
+
+// Seek fast-forwards playback by d of recorded time, counted from the
+// current position (not from the start of the file). Queued
+// keyboard/pointer events within that span are dispatched without
+// sleeping, so the VNC server ends up in a consistent input state
+// instead of e.g. missing a key-up for a key-down it saw.
+func (p *playback) Seek(d time.Duration) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		return errors.New("playback has already stopped")
+	}
+
+	select {
+	case p.signal <- signal{kind: Seek, data: d}:
+	case <-p.ctx.Done():
+		return errors.New("playback has already stopped")
+	}
+
+	return nil
+}
+
 func (p *playback) Stop() error {
 	p.Lock()
 	defer p.Unlock()
@@ -206,12 +289,102 @@ func (p *playback) Stop() error {
 		return errors.New("playback has already stopped")
 	}
 
-	close(p.signal)
+	if p.stream != nil {
+		// avoid closing it inline: Stream.Close calls back into
+		// p.Stream's onClose, which needs p's lock
+		go p.stream.Close()
+	}
+
+	p.cancel()
 	p.closed = true
 
 	return nil
 }
 
+// Stream lazily starts (or returns the existing) live HLS stream of this
+// playback's framebuffer, so `vnc stream <id>` doesn't pay ffmpeg
+// startup cost for playbacks nobody is watching.
+func (p *playback) Stream() (*Stream, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		return nil, errors.New("playback has already stopped")
+	}
+
+	if p.stream != nil {
+		return p.stream, nil
+	}
+
+	s, err := newStream(p.ID, int(p.Conn.s.Width), int(p.Conn.s.Height))
+	if err != nil {
+		return nil, err
+	}
+
+	s.onClose = func() {
+		p.Lock()
+		if p.stream == s {
+			p.stream = nil
+		}
+		p.Unlock()
+	}
+
+	p.stream = s
+
+	go func() {
+		// subscribeScreenshots gives the stream its own subscription to
+		// the frames, rather than racing waitForIt/verifyKeyframe for a
+		// shared channel -- see subscribeScreenshots.
+		sub := p.subscribeScreenshots()
+		defer p.unsubscribeScreenshots(sub)
+
+		for {
+			select {
+			case <-p.ctx.Done():
+				s.Close()
+				return
+			case img := <-sub:
+				if err := s.Write(img); err != nil {
+					log.Error("playback %v: stream write failed: %v", p.ID, err)
+					return
+				}
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+// StreamURL starts (if not already running) this playback's HLS stream
+// and returns the path it's served at. The stream itself takes care of
+// registering with the shared dispatch handler (see stream.go), so URLs
+// stay valid even if this playback's ID is later reused by a fresh
+// playback instance. This is what the `vnc stream <id>` command hands
+// back to the caller.
+func (p *playback) StreamURL() (string, error) {
+	if _, err := p.Stream(); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("/vnc/%v/stream/", p.ID), nil
+}
+
+// StopWithTimeout stops playback like Stop, but reports an error if the
+// playback goroutine -- for example one stuck inside a slow waitForIt --
+// hasn't unwound within d.
+func (p *playback) StopWithTimeout(d time.Duration) error {
+	if err := p.Stop(); err != nil {
+		return err
+	}
+
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(d):
+		return fmt.Errorf("playback %v did not stop within %v", p.ID, d)
+	}
+}
+
 func (p *playback) Inject(cmd string) error {
 	p.Lock()
 	defer p.Unlock()
@@ -220,28 +393,70 @@ func (p *playback) Inject(cmd string) error {
 		return errors.New("playback has already stopped")
 	}
 
+	if strings.HasPrefix(cmd, waitForItPrefix) {
+		e, err := parseWaitForItEvent(strings.TrimPrefix(cmd, waitForItPrefix))
+		if err != nil {
+			return err
+		}
+
+		select {
+		case p.signal <- signal{kind: WaitForIt, data: e}:
+		case <-p.ctx.Done():
+			return errors.New("playback has already stopped")
+		}
+		return nil
+	}
+
 	e, err := parseEvent(cmd)
 	if err != nil {
 		return err
 	}
 
 	if event, ok := e.(Event); ok {
-		p.out <- event
+		select {
+		case p.out <- event:
+		case <-p.ctx.Done():
+			return errors.New("playback has already stopped")
+		}
 		return nil
 	}
 
+	var sig signal
+
 	switch e := e.(type) {
 	case *LoadFileEvent:
-		p.signal <- signal{kind: LoadFile, data: e}
-	case *WaitForItEvent:
-		p.signal <- signal{kind: WaitForIt, data: e}
+		sig = signal{kind: LoadFile, data: e}
+	case *SpeedEvent:
+		sig = signal{kind: Speed, data: e.Speed}
+	case *SeekEvent:
+		sig = signal{kind: Seek, data: e.Duration}
 	default:
 		return fmt.Errorf("unknown event: %v", e)
 	}
 
+	select {
+	case p.signal <- sig:
+	case <-p.ctx.Done():
+		return errors.New("playback has already stopped")
+	}
+
 	return nil
 }
 
+// SpeedEvent is a pseudo-event parsed from an Inject command like
+// "Speed:2.0" -- it changes the playback rate rather than being written
+// to the VNC connection.
+type SpeedEvent struct {
+	Speed float64
+}
+
+// SeekEvent is a pseudo-event parsed from an Inject command like
+// "Seek:30s" -- it fast-forwards playback by that much recorded time from
+// the current position rather than being written to the VNC connection.
+type SeekEvent struct {
+	Duration time.Duration
+}
+
 func (p *playback) GetStep() (string, error) {
 	p.Lock()
 	defer p.Unlock()
@@ -276,8 +491,21 @@ func (v *playback) playFile(parent *os.File, filename string) error {
 		v.resetFile(old)
 	}()
 
-	scanner := bufio.NewScanner(f)
+	scanner, header, err := openPlaybackFile(f)
+	if err != nil {
+		return err
+	}
+
+	v.setHeader(header)
+
+	if header != nil && header.Width != 0 && header.Height != 0 {
+		if header.Width != int(v.Conn.s.Width) || header.Height != int(v.Conn.s.Height) {
+			log.Warn("playback %v: %v was recorded at %vx%v, target is %vx%v -- pointer events may not line up",
+				v.ID, f.Name(), header.Width, header.Height, v.Conn.s.Width, v.Conn.s.Height)
+		}
+	}
 
+ScanLoop:
 	for scanner.Scan() {
 		// Parse the event
 		s := strings.SplitN(scanner.Text(), ":", 2)
@@ -294,10 +522,29 @@ func (v *playback) playFile(parent *os.File, filename string) error {
 			continue
 		}
 
-		res, err := parseEvent(s[1])
-		if err != nil {
-			log.Error("invalid vnc message: `%s`", s[1])
-			continue
+		var res interface{}
+
+		if strings.HasPrefix(s[1], "Keyframe,") {
+			spec, err := parseKeyframeSpec(s[1])
+			if err != nil {
+				log.Error("invalid keyframe line: %v", err)
+				continue
+			}
+			res = spec
+		} else if strings.HasPrefix(s[1], waitForItPrefix) {
+			e, err := parseWaitForItEvent(strings.TrimPrefix(s[1], waitForItPrefix))
+			if err != nil {
+				log.Error("invalid WaitForIt line: %v", err)
+				continue
+			}
+			res = e
+		} else {
+			e, err := parseEvent(s[1])
+			if err != nil {
+				log.Error("invalid vnc message: `%s`", s[1])
+				continue
+			}
+			res = e
 		}
 
 		// Set the current event context
@@ -311,20 +558,21 @@ func (v *playback) playFile(parent *os.File, filename string) error {
 
 		for {
 			start := time.Now()
+			speed := v.getSpeed()
+			wait := time.Duration(float64(duration) / speed)
 
 			select {
-			case <-time.After(duration):
+			case <-v.ctx.Done():
+				log.Info("abort playback of %v: %v", f.Name(), v.ctx.Err())
+				return nil
+			case <-time.After(wait):
 				v.addDuration(-duration)
 
 				goto Event
-			case sig, ok := <-v.signal:
-				if !ok {
-					// signal channel closed -- bail
-					log.Info("abort playback of %v due to signal", f.Name())
-					return nil
-				}
-
-				waited := start.Sub(time.Now())
+			case sig := <-v.signal:
+				// convert the wall-clock time we waited back into recorded
+				// time, accounting for the current speed
+				waited := time.Duration(float64(time.Now().Sub(start)) * speed)
 				v.addDuration(-waited)
 
 				// don't need to wait as long next time
@@ -332,18 +580,17 @@ func (v *playback) playFile(parent *os.File, filename string) error {
 
 				switch sig.kind {
 				case Pause:
-					sig, ok := <-v.signal
-					if !ok {
-						// signal channel closed -- bail
-						log.Info("abort playback of %v due to signal", f.Name())
+					select {
+					case <-v.ctx.Done():
+						log.Info("abort playback of %v: %v", f.Name(), v.ctx.Err())
 						return nil
-					}
-
-					switch sig.kind {
-					case Play:
-						// do nothing except keep playing
-					default:
-						log.Error("unexpected signal: %v", sig)
+					case sig := <-v.signal:
+						switch sig.kind {
+						case Play:
+							// do nothing except keep playing
+						default:
+							log.Error("unexpected signal: %v", sig)
+						}
 					}
 				case LoadFile:
 					e := sig.data.(LoadFileEvent)
@@ -363,6 +610,36 @@ func (v *playback) playFile(parent *os.File, filename string) error {
 					v.addDuration(-duration)
 
 					goto Event
+				case Speed:
+					v.setSpeed(sig.data.(float64))
+				case Seek:
+					switch res.(type) {
+					case Event, *LoadFileEvent:
+						// flush the event we were already waiting to
+						// send before fast-forwarding, so a key-down
+						// doesn't get reordered after a key-up seek
+						// skips past; LoadFile doesn't block on
+						// framebuffer state so it's safe to recurse
+						// into here too
+						if err := v.dispatchEvent(f, res); err != nil {
+							return err
+						}
+					case *WaitForItEvent:
+						// a Seek is often issued specifically to escape
+						// a stuck wait -- dispatching it here would
+						// block the seek on the exact wait it's meant
+						// to skip, same as seek() skips WaitForIt lines
+						// later in the file
+						log.Info("playback %v: skipping pending WaitForIt during seek", v.ID)
+					case *keyframeSpec:
+						log.Info("playback %v: skipping pending keyframe verification during seek", v.ID)
+					}
+
+					if err := v.seek(f, scanner, sig.data.(time.Duration)); err != nil {
+						return err
+					}
+
+					continue ScanLoop
 				default:
 					log.Error("unexpected signal: %v", sig)
 				}
@@ -371,36 +648,68 @@ func (v *playback) playFile(parent *os.File, filename string) error {
 
 		// waited so process the event
 	Event:
-		switch e := res.(type) {
-		case Event:
-			v.out <- e
-		case *LoadFileEvent:
-			if err := v.playFile(f, e.File); err != nil {
-				return err
-			}
-		case *WaitForItEvent:
-			if err := v.waitForIt(e); err != nil {
-				return err
-			}
+		if err := v.dispatchEvent(f, res); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// dispatchEvent sends res -- an event parsed from a playback file -- to
+// the VNC connection, or recurses/waits as appropriate for the pseudo-
+// events. Used both for the normal per-line dispatch and to flush an
+// already-parsed, still-pending event before a Seek fast-forwards past
+// it, so ordering between the two is preserved.
+func (v *playback) dispatchEvent(f *os.File, res interface{}) error {
+	switch e := res.(type) {
+	case Event:
+		select {
+		case v.out <- e:
+		case <-v.ctx.Done():
+		}
+	case *LoadFileEvent:
+		return v.playFile(f, e.File)
+	case *WaitForItEvent:
+		return v.waitForIt(e)
+	case *keyframeSpec:
+		return v.verifyKeyframe(f, e)
+	}
+
+	return nil
+}
+
 func (p *playback) waitForIt(e *WaitForItEvent) error {
 	timeout := time.Duration(e.Timeout) * time.Nanosecond
 
 	log.Info("playback %v, wait for %v, timeout = %v", p.ID, e.File, timeout)
 
-	// TODO: load image
+	f, err := os.Open(e.File)
+	if err != nil {
+		return fmt.Errorf("unable to open reference image %v: %v", e.File, err)
+	}
+
+	ref, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("unable to decode reference image %v: %v", e.File, err)
+	}
+
+	refHash := dHash(crop(ref, e.Rect))
+
+	threshold := e.Threshold
+	if threshold == 0 {
+		threshold = defaultHashThreshold
+	}
 
 	fb := &FramebufferUpdateRequest{
 		Width:  p.Conn.s.Width,
 		Height: p.Conn.s.Height,
 	}
 
-	var i int
+	sub := p.subscribeScreenshots()
+	defer p.unsubscribeScreenshots(sub)
+
 	for timeout > 0 {
 		// request an updated screenshot
 		if err := fb.Write(p.Conn); err != nil {
@@ -410,24 +719,19 @@ func (p *playback) waitForIt(e *WaitForItEvent) error {
 		start := time.Now()
 
 		select {
-		case screenshot := <-p.screenshots:
+		case <-p.ctx.Done():
+			return fmt.Errorf("playback %v stopped while waiting for %v", p.ID, e.File)
+		case screenshot := <-sub:
 			waited := time.Now().Sub(start)
 			timeout -= waited
 
 			log.Info("playback %v got screenshot after %v", p.ID, waited)
 
-			// TODO: check for image
-			f, err := os.Create(fmt.Sprintf("screenshot-%v.png", i))
-			if err != nil {
-				return fmt.Errorf("screenshot failed to write: %v", err)
-			}
-
-			i += 1
-
-			if err := png.Encode(f, screenshot); err != nil {
-				return fmt.Errorf("unable to encode screenshot: %v", err)
+			hash := dHash(crop(screenshot, e.Rect))
+			if dist := hammingDistance(hash, refHash); dist <= threshold {
+				log.Info("playback %v matched %v, hamming distance %v", p.ID, e.File, dist)
+				return nil
 			}
-			f.Close()
 		case <-time.After(timeout):
 			return fmt.Errorf("timeout waiting for %v", e.File)
 		}
@@ -464,6 +768,138 @@ func (p *playback) resetFile(old *os.File) {
 	p.file = old
 }
 
+func (p *playback) getSpeed() float64 {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.speed
+}
+
+func (p *playback) setSpeed(f float64) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.speed = f
+}
+
+// subscribeScreenshots registers a new consumer of this playback's
+// framebuffer screenshots and returns the channel it will receive them
+// on. Every FramebufferUpdate is fanned out to all current subscribers
+// independently, so a long-lived consumer like the HLS stream -- which
+// is always ready to receive -- can't win every frame and starve a
+// short-lived one like waitForIt/verifyKeyframe out of the screenshots
+// they're blocked waiting for.
+func (p *playback) subscribeScreenshots() chan *image.RGBA {
+	ch := make(chan *image.RGBA)
+
+	p.Lock()
+	p.screenshotSubs[ch] = true
+	p.Unlock()
+
+	return ch
+}
+
+// unsubscribeScreenshots deregisters a channel returned by
+// subscribeScreenshots; callers should defer this once they're done
+// consuming it.
+func (p *playback) unsubscribeScreenshots(ch chan *image.RGBA) {
+	p.Lock()
+	delete(p.screenshotSubs, ch)
+	p.Unlock()
+}
+
+// broadcastScreenshot fans img out to every subscribed channel, dropping
+// it for any subscriber that isn't ready to receive right now rather
+// than blocking the caller (the goroutine reading the VNC connection) on
+// a slow consumer.
+func (p *playback) broadcastScreenshot(img *image.RGBA) {
+	p.Lock()
+	defer p.Unlock()
+
+	for ch := range p.screenshotSubs {
+		select {
+		case ch <- img:
+		default:
+		}
+	}
+}
+
+// seek fast-forwards through scanner, dispatching up to target worth of
+// recorded time to v.out without sleeping, so that key-down/key-up and
+// pointer-move pairs both make it to the VNC server. WaitForIt events are
+// skipped, since satisfying one requires watching the framebuffer rather
+// than just replaying input. A LoadFile line is not fast-forwarded: the
+// nested file is played through playFile at its normal pace, and only the
+// LoadFile line's own duration counts toward target.
+func (v *playback) seek(f *os.File, scanner *bufio.Scanner, target time.Duration) error {
+	for target > 0 && scanner.Scan() {
+		s := strings.SplitN(scanner.Text(), ":", 2)
+		if len(s) != 2 || strings.HasPrefix(s[0], "#") {
+			continue
+		}
+
+		d, err := time.ParseDuration(s[0] + "ns")
+		if err != nil {
+			continue
+		}
+
+		if strings.HasPrefix(s[1], "Keyframe,") {
+			v.setStep(scanner.Text())
+			v.addDuration(-d)
+			target -= d
+
+			log.Info("playback %v: skipping keyframe verification during seek", v.ID)
+			continue
+		}
+
+		var res interface{}
+
+		if strings.HasPrefix(s[1], waitForItPrefix) {
+			e, err := parseWaitForItEvent(strings.TrimPrefix(s[1], waitForItPrefix))
+			if err != nil {
+				log.Error("invalid WaitForIt line: %v", err)
+				continue
+			}
+			res = e
+		} else {
+			e, err := parseEvent(s[1])
+			if err != nil {
+				log.Error("invalid vnc message: `%s`", s[1])
+				continue
+			}
+			res = e
+		}
+
+		v.setStep(scanner.Text())
+		v.addDuration(-d)
+		target -= d
+
+		switch e := res.(type) {
+		case Event:
+			select {
+			case v.out <- e:
+			case <-v.ctx.Done():
+				return nil
+			}
+		case *LoadFileEvent:
+			if err := v.playFile(f, e.File); err != nil {
+				return err
+			}
+		case *WaitForItEvent:
+			log.Info("playback %v: skipping WaitForIt on %v during seek", v.ID, e.File)
+		}
+	}
+
+	return nil
+}
+
+func (p *playback) setHeader(h *playbackHeader) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.header = h
+}
+
 func (p *playback) setStep(s string) {
 	p.Lock()
 	defer p.Unlock()
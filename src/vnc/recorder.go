@@ -0,0 +1,162 @@
+// Copyright (2019) Sandia Corporation.
+// Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+// the U.S. Government retains certain rights in this software.
+
+package vnc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/png"
+	log "minilog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// recorder captures VNC input events, interleaved with periodic
+// framebuffer keyframes, into a single archive that playFile can later
+// verify against.
+type recorder struct {
+	*Conn // embed
+
+	ID    string // ID to identify the recording
+	rhost string // remote host
+
+	sync.Mutex               // guards below
+	start      time.Time     // start of the recording
+	last       time.Time     // time of the last recorded line
+	file       *os.File      // archive being written to
+	dir        string        // directory keyframe PNGs are written alongside file
+	interval   time.Duration // how often to capture a keyframe
+	n          int           // keyframe counter, used to name kf-N.png
+	closed     bool
+}
+
+// newRecorder creates a recorder that writes events and keyframes to
+// filename, which is created or truncated, capturing a keyframe every
+// interval.
+func newRecorder(id, rhost, filename string, interval time.Duration) (*recorder, error) {
+	conn, err := Dial(rhost)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	return &recorder{
+		Conn:     conn,
+		ID:       id,
+		rhost:    rhost,
+		start:    now,
+		last:     now,
+		file:     f,
+		dir:      filepath.Dir(filename),
+		interval: interval,
+	}, nil
+}
+
+// sinceLast returns the time elapsed since the previous recorded line
+// and advances r.last to now, so consecutive lines encode the same
+// delta-since-previous-line duration that playFile's scanner expects.
+func (r *recorder) sinceLast() time.Duration {
+	now := time.Now()
+	d := now.Sub(r.last)
+	r.last = now
+	return d
+}
+
+// RecordEvent appends e to the archive, timestamped with the time
+// elapsed since the previous recorded line -- the same "duration:event"
+// line shape playFile already knows how to read.
+func (r *recorder) RecordEvent(e Event) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		return fmt.Errorf("recorder %v is closed", r.ID)
+	}
+
+	_, err := fmt.Fprintf(r.file, "%d:%v\n", r.sinceLast().Nanoseconds(), e)
+	return err
+}
+
+// RecordKeyframe writes img to disk as kf-N.png and appends a Keyframe
+// line referencing its name and sha256, for playFile to verify against
+// during replay.
+func (r *recorder) RecordKeyframe(img *image.RGBA) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		return fmt.Errorf("recorder %v is closed", r.ID)
+	}
+
+	name := fmt.Sprintf("kf-%d.png", r.n)
+	r.n++
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return fmt.Errorf("unable to encode keyframe %v: %v", name, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(r.dir, name), buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("unable to write keyframe %v: %v", name, err)
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+
+	_, err := fmt.Fprintf(r.file, "%d:Keyframe,sha256=%s,file=%s\n",
+		r.sinceLast().Nanoseconds(), hex.EncodeToString(sum[:]), name)
+	return err
+}
+
+// Run captures a keyframe from screenshots every r.interval until the
+// recorder is closed. Ticks for which no fresh frame has arrived yet are
+// skipped rather than blocked on.
+func (r *recorder) Run(screenshots <-chan *image.RGBA) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		r.Lock()
+		closed := r.closed
+		r.Unlock()
+
+		if closed {
+			return
+		}
+
+		select {
+		case img := <-screenshots:
+			if err := r.RecordKeyframe(img); err != nil {
+				log.Error("recorder %v: %v", r.ID, err)
+			}
+		default:
+			// no fresh frame this tick -- try again next
+		}
+	}
+}
+
+// Close stops recording and closes the archive file and VNC connection.
+func (r *recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		return fmt.Errorf("recorder %v is already closed", r.ID)
+	}
+	r.closed = true
+
+	r.Conn.Close()
+	return r.file.Close()
+}
@@ -0,0 +1,369 @@
+// Copyright (2019) Sandia Corporation.
+// Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+// the U.S. Government retains certain rights in this software.
+
+package vnc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	log "minilog"
+	"net/http"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// streamSegmentDuration is the length of each HLS chunk.
+	streamSegmentDuration = 2 * time.Second
+
+	// streamWindow is the number of finished chunks kept around for the
+	// playlist; older ones are pruned.
+	streamWindow = 5
+
+	// streamIdleTimeout tears down the encoder once nobody has fetched a
+	// segment for this long.
+	streamIdleTimeout = 30 * time.Second
+)
+
+var (
+	streamsMu   sync.Mutex
+	streams     = map[string]*Stream{} // playback ID -> its live Stream
+	streamMount sync.Once
+)
+
+// mountStreamHandler registers, once per process, a single handler on
+// http.DefaultServeMux that dispatches by playback ID to whichever
+// *Stream is currently registered for it. Streams come and go as
+// playbacks are created and stopped, but the same ID can be reused by a
+// later playback -- a bare http.Handle per ID would panic the second
+// time the ID came around ("multiple registrations"), so instead we
+// register the pattern exactly once and look the Stream up per request.
+func mountStreamHandler() {
+	streamMount.Do(func() {
+		http.HandleFunc("/vnc/", dispatchStream)
+	})
+}
+
+// dispatchStream routes a request under /vnc/<id>/stream/... to the
+// Stream registered for <id>, if any.
+func dispatchStream(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/vnc/"), "/stream/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	streamsMu.Lock()
+	s := streams[parts[0]]
+	streamsMu.Unlock()
+
+	if s == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL.Path = "/" + parts[1]
+	s.ServeHTTP(w, r2)
+}
+
+// Chunk is one segment of a live HLS stream: an in-memory MPEG-TS blob,
+// plus a notify channel that's closed once encoding of the segment
+// finishes so a request for it can block until it's ready.
+type Chunk struct {
+	id     int
+	done   bool
+	buf    bytes.Buffer
+	notify chan bool
+}
+
+// Stream encodes a playback's framebuffer to HLS: frames are piped into
+// an ffmpeg child process as raw RGBA video, and ffmpeg's MPEG-TS output
+// is cut into Chunks that ServeHTTP serves as index.m3u8 and chunk-N.ts.
+type Stream struct {
+	id string // playback ID this stream belongs to
+
+	sync.Mutex // guards below
+	chunks     map[int]*Chunk
+	nextChunk  int
+	lastAccess time.Time
+	cmd        *exec.Cmd
+	stdin      io.WriteCloser
+	canvas     *image.RGBA // full w x h frame; FramebufferUpdates paint their rect into it
+	closed     bool
+	onClose    func() // called once, after Close tears the encoder down
+}
+
+// newStream starts the ffmpeg child process that encodes w x h RGBA
+// frames into an MPEG-TS stream, and starts the goroutines that segment
+// its output and watch for idleness.
+func newStream(id string, w, h int) (*Stream, error) {
+	cmd := exec.Command("ffmpeg",
+		"-f", "rawvideo",
+		"-pix_fmt", "rgba",
+		"-s", fmt.Sprintf("%dx%d", w, h),
+		"-r", "10",
+		"-i", "-",
+		"-c:v", "libx264",
+		"-preset", "ultrafast",
+		"-tune", "zerolatency",
+		"-f", "mpegts",
+		"-",
+	)
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open ffmpeg stdin: %v", err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("unable to open ffmpeg stdout: %v", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start ffmpeg: %v", err)
+	}
+
+	s := &Stream{
+		id:         id,
+		chunks:     make(map[int]*Chunk),
+		lastAccess: time.Now(),
+		cmd:        cmd,
+		stdin:      stdin,
+		canvas:     image.NewRGBA(image.Rect(0, 0, w, h)),
+	}
+
+	go func() {
+		// segment returns once ffmpeg's stdout hits EOF, which happens
+		// whether it exited on its own or was Kill()ed by Close --
+		// either way Wait it so its process doesn't linger as a zombie
+		s.segment(stdout)
+		if err := s.cmd.Wait(); err != nil {
+			log.Debug("stream %v: ffmpeg exited: %v", s.id, err)
+		}
+	}()
+	go s.watchIdle()
+
+	mountStreamHandler()
+
+	streamsMu.Lock()
+	streams[id] = s
+	streamsMu.Unlock()
+
+	return s, nil
+}
+
+// Write paints a FramebufferUpdate rectangle onto the stream's canvas and
+// feeds the resulting full w x h frame into the encoder. img is usually a
+// dirty-region update smaller than the canvas, not a full frame, so it
+// can't be piped to ffmpeg as-is -- ffmpeg's rawvideo input expects
+// exactly w*h*4 bytes per frame, and a short write would desync every
+// frame boundary after it.
+func (s *Stream) Write(img *image.RGBA) error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return errors.New("stream is closed")
+	}
+
+	draw.Draw(s.canvas, img.Bounds(), img, img.Bounds().Min, draw.Src)
+	frame := append([]byte(nil), s.canvas.Pix...)
+	s.Unlock()
+
+	_, err := s.stdin.Write(frame)
+	return err
+}
+
+// segment reads ffmpeg's MPEG-TS output and time-boxes it into
+// streamSegmentDuration-long Chunks.
+func (s *Stream) segment(r io.Reader) {
+	buf := make([]byte, 32*1024)
+
+	chunk := s.newChunk()
+	deadline := time.Now().Add(streamSegmentDuration)
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			s.Lock()
+			chunk.buf.Write(buf[:n])
+			s.Unlock()
+		}
+
+		if time.Now().After(deadline) {
+			s.finishChunk(chunk)
+			chunk = s.newChunk()
+			deadline = time.Now().Add(streamSegmentDuration)
+		}
+
+		if err != nil {
+			s.finishChunk(chunk)
+			return
+		}
+	}
+}
+
+func (s *Stream) newChunk() *Chunk {
+	s.Lock()
+	defer s.Unlock()
+
+	c := &Chunk{id: s.nextChunk, notify: make(chan bool)}
+	s.nextChunk++
+	s.chunks[c.id] = c
+
+	for id := range s.chunks {
+		if c.id-id > streamWindow {
+			delete(s.chunks, id)
+		}
+	}
+
+	return c
+}
+
+func (s *Stream) finishChunk(c *Chunk) {
+	s.Lock()
+	c.done = true
+	s.Unlock()
+
+	close(c.notify)
+}
+
+// watchIdle tears down the encoder once streamIdleTimeout passes without
+// a client requesting a segment.
+func (s *Stream) watchIdle() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.Lock()
+		idle := time.Since(s.lastAccess)
+		closed := s.closed
+		s.Unlock()
+
+		if closed {
+			return
+		}
+
+		if idle > streamIdleTimeout {
+			log.Info("stream %v idle for %v, tearing down encoder", s.id, idle)
+			s.Close()
+			return
+		}
+	}
+}
+
+// Close kills the ffmpeg child process and marks the stream closed.
+func (s *Stream) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil
+	}
+	s.closed = true
+	onClose := s.onClose
+	s.Unlock()
+
+	streamsMu.Lock()
+	if streams[s.id] == s {
+		delete(streams, s.id)
+	}
+	streamsMu.Unlock()
+
+	s.stdin.Close()
+	if s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+	}
+
+	if onClose != nil {
+		onClose()
+	}
+
+	return nil
+}
+
+// ServeHTTP serves this stream's index.m3u8 and chunk-N.ts, meant to be
+// mounted under minimega's existing HTTP surface (e.g.
+// /vnc/<id>/stream/) so that `vnc stream <id>` can hand back a URL.
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+
+	switch {
+	case name == "index.m3u8":
+		s.servePlaylist(w)
+	case strings.HasPrefix(name, "chunk-") && strings.HasSuffix(name, ".ts"):
+		s.serveChunk(w, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Stream) servePlaylist(w http.ResponseWriter) {
+	s.Lock()
+	ids := make([]int, 0, len(s.chunks))
+	for id, c := range s.chunks {
+		if c.done {
+			ids = append(ids, id)
+		}
+	}
+	s.Unlock()
+
+	sort.Ints(ids)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n", int(streamSegmentDuration.Seconds()))
+	if len(ids) > 0 {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", ids[0])
+	}
+	for _, id := range ids {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nchunk-%d.ts\n", streamSegmentDuration.Seconds(), id)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Write([]byte(b.String()))
+}
+
+func (s *Stream) serveChunk(w http.ResponseWriter, name string) {
+	// only segment requests count as activity for watchIdle
+	s.Lock()
+	s.lastAccess = time.Now()
+	s.Unlock()
+
+	idStr := strings.TrimSuffix(strings.TrimPrefix(name, "chunk-"), ".ts")
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "invalid chunk", http.StatusBadRequest)
+		return
+	}
+
+	s.Lock()
+	c, ok := s.chunks[id]
+	s.Unlock()
+
+	if !ok {
+		http.NotFound(w, nil)
+		return
+	}
+
+	// block until this segment finishes encoding
+	<-c.notify
+
+	s.Lock()
+	data := c.buf.Bytes()
+	s.Unlock()
+
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Write(data)
+}